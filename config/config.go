@@ -0,0 +1,97 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"net"
+	"time"
+)
+
+// GlobalType holds the local speaker's own configuration.
+type GlobalType struct {
+	As        uint32
+	RouterId  net.IP
+	Collector CollectorType
+}
+
+// CollectorType configures the OpenTracing/Zipkin collector.
+type CollectorType struct {
+	Enabled bool
+	Address string
+}
+
+// TimerType holds the per-peer timer configuration.
+type TimerType struct {
+	ConnectRetry      int
+	HoldTime          int
+	KeepaliveInterval int
+	DelayOpenTime     int
+	Backoff           BackoffType
+}
+
+// BackoffType tunes the connect-retry/idle-hold backoff. BaseDelay and
+// MaxDelay are in milliseconds; a zero field falls back to the default.
+type BackoffType struct {
+	BaseDelay  int64
+	MaxDelay   int64
+	Multiplier float64
+	Jitter     float64
+}
+
+// BgpNeighborCommonState holds the per-peer message and error counters.
+type BgpNeighborCommonState struct {
+	TotalIn        int
+	TotalOut       int
+	OpenIn         int
+	OpenOut        int
+	UpdateIn       int
+	UpdateOut      int
+	UpdateRecvTime time.Time
+	NotifyIn       int
+	NotifyOut      int
+	KeepaliveIn    int
+	KeepaliveOut   int
+	RefreshIn      int
+	RefreshOut     int
+
+	IdleHoldTimerExpiredCount  int
+	ExpiredHoldTimerCount      int
+	ConnectRetryCount          int
+	IncomingQueueHighWatermark int64
+}
+
+// NeighborType holds the configuration for a single peer.
+type NeighborType struct {
+	NeighborAddress        net.IP
+	PeerAs                 uint32
+	Timers                 TimerType
+	GracefulRestart        GracefulRestartType
+	AfiSafiList            []AfiSafiType
+	BgpNeighborCommonState BgpNeighborCommonState
+}
+
+// GracefulRestartType configures RFC 4724 graceful restart for a peer.
+type GracefulRestartType struct {
+	Enabled         bool
+	RestartTime     int
+	RestartFlagSet  bool
+	ForwardingState bool
+}
+
+// AfiSafiType names one address family negotiated with a peer.
+type AfiSafiType struct {
+	AfiSafiName string
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package queue implements an unbounded FIFO channel, modeled on
+// eapache/channels' InfiniteChannel.
+package queue
+
+import "sync/atomic"
+
+const chunkSize = 64
+
+type chunk struct {
+	buf  []interface{}
+	next *chunk
+}
+
+func newChunk() *chunk {
+	return &chunk{buf: make([]interface{}, 0, chunkSize)}
+}
+
+// Queue is an unbounded FIFO. The zero value is not usable; use New.
+type Queue struct {
+	in, out chan interface{}
+	length  int64
+}
+
+// New starts the relay goroutine and returns a ready Queue.
+func New() *Queue {
+	q := &Queue{
+		in:  make(chan interface{}),
+		out: make(chan interface{}),
+	}
+	go q.relay()
+	return q
+}
+
+// In returns the channel to write values to. Sends never block on
+// queue capacity, only on the relay goroutine being ready to accept.
+func (q *Queue) In() chan<- interface{} {
+	return q.in
+}
+
+// Out returns the channel to read values from, in FIFO order. It closes
+// once In() is closed and all buffered values have been delivered.
+func (q *Queue) Out() <-chan interface{} {
+	return q.out
+}
+
+// Len returns the number of values currently buffered. Safe from any
+// goroutine.
+func (q *Queue) Len() int64 {
+	return atomic.LoadInt64(&q.length)
+}
+
+// Close shuts down the input side; buffered values still drain via Out().
+func (q *Queue) Close() {
+	close(q.in)
+}
+
+func (q *Queue) relay() {
+	defer close(q.out)
+	head := newChunk()
+	tail := head
+
+	for {
+		if len(head.buf) == 0 {
+			if head.next != nil {
+				head = head.next
+				continue
+			}
+			if q.in == nil {
+				return
+			}
+			v, ok := <-q.in
+			if !ok {
+				q.in = nil
+				continue
+			}
+			head.buf = append(head.buf, v)
+			atomic.AddInt64(&q.length, 1)
+			continue
+		}
+
+		select {
+		case v, ok := <-q.in:
+			if !ok {
+				q.in = nil
+				continue
+			}
+			if len(tail.buf) == cap(tail.buf) {
+				next := newChunk()
+				tail.next = next
+				tail = next
+			}
+			tail.buf = append(tail.buf, v)
+			atomic.AddInt64(&q.length, 1)
+		case q.out <- head.buf[0]:
+			head.buf = head.buf[1:]
+			atomic.AddInt64(&q.length, -1)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForLen polls Len() until it matches want or the deadline passes;
+// the relay goroutine updates length after receiving off In(), so a
+// reader can observe a stale value for a brief window after a send.
+func waitForLen(t *testing.T, q *Queue, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if l := q.Len(); l == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Len() never reached %d", want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFIFOOrder(t *testing.T) {
+	q := New()
+	const n = chunkSize*2 + 3
+	for i := 0; i < n; i++ {
+		q.In() <- i
+	}
+	for i := 0; i < n; i++ {
+		if v := <-q.Out(); v != i {
+			t.Fatalf("got %v, want %v", v, i)
+		}
+	}
+}
+
+func TestCloseDrainsBufferedValues(t *testing.T) {
+	q := New()
+	for i := 0; i < chunkSize+1; i++ {
+		q.In() <- i
+	}
+	q.Close()
+	for i := 0; i < chunkSize+1; i++ {
+		v, ok := <-q.Out()
+		if !ok {
+			t.Fatalf("Out() closed early at index %d", i)
+		}
+		if v != i {
+			t.Fatalf("got %v, want %v", v, i)
+		}
+	}
+	if _, ok := <-q.Out(); ok {
+		t.Fatal("Out() did not close after draining")
+	}
+}
+
+func TestLen(t *testing.T) {
+	q := New()
+	q.In() <- 1
+	q.In() <- 2
+	waitForLen(t, q, 2)
+	<-q.Out()
+	waitForLen(t, q, 1)
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+)
+
+// newBackoffStrategy builds the per-peer backoff, falling back to
+// defaultBackoff for any zero-valued Timers.Backoff field.
+func newBackoffStrategy(t config.TimerType) backoffStrategy {
+	c := defaultBackoff
+	if t.Backoff.BaseDelay != 0 {
+		c.BaseDelay = time.Duration(t.Backoff.BaseDelay) * time.Millisecond
+	}
+	if t.Backoff.MaxDelay != 0 {
+		c.MaxDelay = time.Duration(t.Backoff.MaxDelay) * time.Millisecond
+	}
+	if t.Backoff.Multiplier != 0 {
+		c.Multiplier = t.Backoff.Multiplier
+	}
+	if t.Backoff.Jitter != 0 {
+		c.Jitter = t.Backoff.Jitter
+	}
+	return newExponentialBackoff(c)
+}
+
+// backoffStrategy returns the delay for retry attempt n (0-based).
+// Modeled on grpc-go's connection backoff.
+type backoffStrategy interface {
+	Backoff(n int) time.Duration
+}
+
+// defaultBackoffConfig: delay grows as BaseDelay * Multiplier^n, capped
+// at MaxDelay, then jittered by +/- Jitter.
+type defaultBackoffConfig struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+var defaultBackoff = defaultBackoffConfig{
+	BaseDelay:  time.Second,
+	MaxDelay:   2 * time.Minute,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+}
+
+// exponentialBackoff is the default backoffStrategy implementation.
+type exponentialBackoff struct {
+	config defaultBackoffConfig
+}
+
+func newExponentialBackoff(config defaultBackoffConfig) *exponentialBackoff {
+	return &exponentialBackoff{config: config}
+}
+
+func (b *exponentialBackoff) Backoff(n int) time.Duration {
+	c := b.config
+	if n == 0 {
+		return jitter(c.BaseDelay, c.Jitter)
+	}
+	delay := float64(c.BaseDelay)
+	for delay < float64(c.MaxDelay) && n > 0 {
+		delay *= c.Multiplier
+		n--
+	}
+	if delay > float64(c.MaxDelay) {
+		delay = float64(c.MaxDelay)
+	}
+	return jitter(time.Duration(delay), c.Jitter)
+}
+
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	delta := fraction * (rand.Float64()*2 - 1)
+	jittered := float64(d) * (1 + delta)
+	if jittered < 0 {
+		return 0
+	}
+	return time.Duration(jittered)
+}
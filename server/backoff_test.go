@@ -0,0 +1,62 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoffGrowsAndCaps(t *testing.T) {
+	c := defaultBackoffConfig{
+		BaseDelay:  time.Second,
+		MaxDelay:   32 * time.Second,
+		Multiplier: 2,
+		Jitter:     0,
+	}
+	b := newExponentialBackoff(c)
+
+	want := c.BaseDelay
+	for n := 0; n < 10; n++ {
+		if got := b.Backoff(n); got != want {
+			t.Fatalf("Backoff(%d) = %v, want %v", n, got, want)
+		}
+		want *= time.Duration(c.Multiplier)
+		if want > c.MaxDelay {
+			want = c.MaxDelay
+		}
+	}
+}
+
+func TestExponentialBackoffJitterBounds(t *testing.T) {
+	c := defaultBackoffConfig{
+		BaseDelay:  time.Second,
+		MaxDelay:   time.Minute,
+		Multiplier: 1.6,
+		Jitter:     0.2,
+	}
+	b := newExponentialBackoff(c)
+
+	for n := 0; n < 20; n++ {
+		d := b.Backoff(n)
+		if d < 0 {
+			t.Fatalf("Backoff(%d) = %v, want >= 0", n, d)
+		}
+		if d > c.MaxDelay+time.Duration(float64(c.MaxDelay)*c.Jitter)+1 {
+			t.Fatalf("Backoff(%d) = %v exceeds jittered max", n, d)
+		}
+	}
+}
@@ -18,13 +18,22 @@ package server
 import (
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/internal/queue"
 	"github.com/osrg/gobgp/packet"
 	"gopkg.in/tomb.v2"
 	"net"
 	"time"
 )
 
+const (
+	holdtimeOpensent = 240
+)
+
+// MaxQueueLen bounds how many messages may sit in an FSM's incoming queue.
+var MaxQueueLen int64 = 4096
+
 type fsmMsgType int
 
 const (
@@ -36,17 +45,30 @@ const (
 type fsmMsg struct {
 	MsgType fsmMsgType
 	MsgData interface{}
+	// Span is non-nil for an UPDATE; pushIncoming finishes it once queued.
+	Span opentracing.Span
 }
 
 type FSM struct {
-	globalConfig    *config.GlobalType
-	peerConfig      *config.NeighborType
-	keepaliveTicker *time.Ticker
-	state           bgp.FSMState
-	incoming        chan *fsmMsg
-	outgoing        chan *bgp.BGPMessage
-	passiveConn     *net.TCPConn
-	passiveConnCh   chan *net.TCPConn
+	globalConfig       *config.GlobalType
+	peerConfig         *config.NeighborType
+	keepaliveTicker    *time.Ticker
+	state              bgp.FSMState
+	incoming           *queue.Queue
+	outgoing           *queue.Queue
+	passiveConn        *net.TCPConn
+	passiveConnCh      chan *net.TCPConn
+	backoff            backoffStrategy
+	connectAttempt     int
+	idleAttempt        int
+	gracefulRestart    *gracefulRestartState
+	staleRouteHandler  StaleRouteHandler
+	negotiatedHoldTime time.Duration
+}
+
+// SetStaleRouteHandler wires in the RIB's graceful-restart callbacks.
+func (fsm *FSM) SetStaleRouteHandler(h StaleRouteHandler) {
+	fsm.staleRouteHandler = h
 }
 
 func (fsm *FSM) bgpMessageStateUpdate(MessageType uint8, isIn bool) {
@@ -91,15 +113,20 @@ func (fsm *FSM) bgpMessageStateUpdate(MessageType uint8, isIn bool) {
 	}
 }
 
-func NewFSM(gConfig *config.GlobalType, pConfig *config.NeighborType, connCh chan *net.TCPConn, incoming chan *fsmMsg, outgoing chan *bgp.BGPMessage) *FSM {
-	return &FSM{
-		globalConfig:  gConfig,
-		peerConfig:    pConfig,
-		incoming:      incoming,
-		outgoing:      outgoing,
-		state:         bgp.BGP_FSM_IDLE,
-		passiveConnCh: connCh,
+func NewFSM(gConfig *config.GlobalType, pConfig *config.NeighborType, connCh chan *net.TCPConn, incoming *queue.Queue, outgoing *queue.Queue) *FSM {
+	fsm := &FSM{
+		globalConfig:       gConfig,
+		peerConfig:         pConfig,
+		incoming:           incoming,
+		outgoing:           outgoing,
+		state:              bgp.BGP_FSM_IDLE,
+		passiveConnCh:      connCh,
+		backoff:            newBackoffStrategy(pConfig.Timers),
+		gracefulRestart:    &gracefulRestartState{},
+		negotiatedHoldTime: time.Second * time.Duration(pConfig.Timers.HoldTime),
 	}
+	fsm.SetStaleRouteHandler(defaultRIB)
+	return fsm
 }
 
 func (fsm *FSM) StateChange(nextState bgp.FSMState) {
@@ -133,17 +160,40 @@ func (h *FSMHandler) Stop() error {
 	return h.t.Wait()
 }
 
+// sendNotification writes a NOTIFICATION; reason is for the debug log only.
+func (h *FSMHandler) sendNotification(code, subcode uint8, data []byte, reason string) {
+	fsm := h.fsm
+	m := bgp.NewBGPNotificationMessage(code, subcode, data)
+	b, _ := m.Serialize()
+	if fsm.passiveConn != nil {
+		fsm.passiveConn.Write(b)
+	}
+	fsm.bgpMessageStateUpdate(m.Header.Type, false)
+	log.Debugf("Peer (%v) sent NOTIFICATION code %d subcode %d: %s", fsm.peerConfig.NeighborAddress, code, subcode, reason)
+}
+
 func (h *FSMHandler) idle() bgp.FSMState {
 	fsm := h.fsm
-	// TODO: support idle hold timer
 
 	if fsm.keepaliveTicker != nil {
 		fsm.keepaliveTicker.Stop()
 		fsm.keepaliveTicker = nil
 	}
-	return bgp.BGP_FSM_ACTIVE
+
+	idleHoldTimer := time.NewTimer(fsm.backoff.Backoff(fsm.idleAttempt))
+	defer idleHoldTimer.Stop()
+
+	select {
+	case <-h.t.Dying():
+		return 0
+	case <-idleHoldTimer.C:
+		fsm.peerConfig.BgpNeighborCommonState.IdleHoldTimerExpiredCount++
+		fsm.idleAttempt++
+		return bgp.BGP_FSM_CONNECT
+	}
 }
 
+// active waits for a passive connection, then honors DelayOpenTime.
 func (h *FSMHandler) active() bgp.FSMState {
 	fsm := h.fsm
 	select {
@@ -152,11 +202,55 @@ func (h *FSMHandler) active() bgp.FSMState {
 	case conn := <-fsm.passiveConnCh:
 		fsm.passiveConn = conn
 	}
-	// we don't implement delayed open timer so move to opensent right
-	// away.
+	if delay := time.Second * time.Duration(fsm.peerConfig.Timers.DelayOpenTime); delay > 0 {
+		delayOpenTimer := time.NewTimer(delay)
+		defer delayOpenTimer.Stop()
+		select {
+		case <-h.t.Dying():
+			fsm.passiveConn.Close()
+			return 0
+		case <-delayOpenTimer.C:
+		}
+	}
 	return bgp.BGP_FSM_OPENSENT
 }
 
+// connect actively dials the peer, falling back to ACTIVE on fsm.backoff.
+func (h *FSMHandler) connect() bgp.FSMState {
+	fsm := h.fsm
+	raddr := &net.TCPAddr{
+		IP:   fsm.peerConfig.NeighborAddress,
+		Port: bgp.BGP_PORT,
+	}
+	connCh := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, err := net.DialTCP("tcp", nil, raddr)
+		if err != nil {
+			log.Debugf("Peer (%v) active connect failed: %s", fsm.peerConfig.NeighborAddress, err)
+			return
+		}
+		connCh <- conn
+	}()
+
+	retryTimer := time.NewTimer(fsm.backoff.Backoff(fsm.connectAttempt))
+	defer retryTimer.Stop()
+
+	select {
+	case <-h.t.Dying():
+		return 0
+	case conn := <-fsm.passiveConnCh:
+		fsm.passiveConn = conn
+		return bgp.BGP_FSM_OPENSENT
+	case conn := <-connCh:
+		fsm.passiveConn = conn
+		return bgp.BGP_FSM_OPENSENT
+	case <-retryTimer.C:
+		fsm.peerConfig.BgpNeighborCommonState.ConnectRetryCount++
+		fsm.connectAttempt++
+		return bgp.BGP_FSM_ACTIVE
+	}
+}
+
 func buildopen(global *config.GlobalType, peerConf *config.NeighborType) *bgp.BGPMessage {
 	var afi int
 	if peerConf.NeighborAddress.To4() != nil {
@@ -170,13 +264,71 @@ func buildopen(global *config.GlobalType, peerConf *config.NeighborType) *bgp.BG
 		[]bgp.ParameterCapabilityInterface{bgp.NewCapMultiProtocol(uint16(afi), bgp.SAFI_UNICAST)})
 	p3 := bgp.NewOptionParameterCapability(
 		[]bgp.ParameterCapabilityInterface{bgp.NewCapFourOctetASNumber(global.As)})
+	params := []bgp.OptionParameterInterface{p1, p2, p3}
+	if grCap := buildGracefulRestartCapability(peerConf); grCap != nil {
+		params = append(params, bgp.NewOptionParameterCapability(
+			[]bgp.ParameterCapabilityInterface{grCap}))
+	}
 	holdTime := uint16(peerConf.Timers.HoldTime)
 	as := global.As
 	if as > (1<<16)-1 {
 		as = bgp.AS_TRANS
 	}
-	return bgp.NewBGPOpenMessage(uint16(as), holdTime, global.RouterId.String(),
-		[]bgp.OptionParameterInterface{p1, p2, p3})
+	return bgp.NewBGPOpenMessage(uint16(as), holdTime, global.RouterId.String(), params)
+}
+
+// pushIncoming queues e, sending Cease/Out of Resources and returning
+// false once the backlog has reached MaxQueueLen.
+func (h *FSMHandler) pushIncoming(e *fsmMsg) bool {
+	fsm := h.fsm
+	state := &fsm.peerConfig.BgpNeighborCommonState
+	if l := fsm.incoming.Len(); l > state.IncomingQueueHighWatermark {
+		state.IncomingQueueHighWatermark = l
+	}
+	if fsm.incoming.Len() >= MaxQueueLen {
+		h.sendNotification(bgp.BGP_ERROR_CEASE, bgp.BGP_ERROR_SUB_OUT_OF_RESOURCES, nil, "incoming queue exceeded MaxQueueLen")
+		if e.Span != nil {
+			e.Span.SetTag("error", true)
+			e.Span.Finish()
+		}
+		return false
+	}
+	fsm.incoming.In() <- e
+	if e.Span != nil {
+		// this tree has no RIB consumer downstream of fsm.incoming to
+		// hand the span to, so it's finished here, at the point the
+		// UPDATE is actually queued for insertion.
+		e.Span.Finish()
+	}
+	return true
+}
+
+// negotiateHoldTime returns min(local, peer) per RFC 4271 4.2, in seconds.
+func negotiateHoldTime(local, peer int) time.Duration {
+	holdTime := local
+	if peer < holdTime {
+		holdTime = peer
+	}
+	return time.Second * time.Duration(holdTime)
+}
+
+// validateOpenMessage checks the peer's OPEN, sending a NOTIFICATION whose
+// subcode matches the actual validation failure on error.
+func (h *FSMHandler) validateOpenMessage(m *bgp.BGPMessage) error {
+	fsm := h.fsm
+	body := m.Body.(*bgp.BGPOpen)
+
+	as, err := bgp.ValidateOpenMsg(body, fsm.peerConfig.PeerAs)
+	if err != nil {
+		subcode := uint8(bgp.BGP_ERROR_SUB_BAD_PEER_AS)
+		if msgErr, ok := err.(*bgp.MessageError); ok {
+			subcode = msgErr.SubTypeCode
+		}
+		h.sendNotification(bgp.BGP_ERROR_OPEN_MESSAGE_ERROR, subcode, nil, err.Error())
+		return err
+	}
+	fsm.peerConfig.PeerAs = as
+	return nil
 }
 
 func readAll(conn *net.TCPConn, length int) ([]byte, error) {
@@ -220,6 +372,10 @@ func (h *FSMHandler) recvMessageWithError() error {
 		MsgType: FSM_MSG_BGP_MESSAGE,
 		MsgData: m,
 	}
+	if m.Header.Type == bgp.BGP_MSG_UPDATE {
+		// left unfinished; pushIncoming closes it once e is queued
+		e.Span = startFSMSpan(h.fsm, "recv_update")
+	}
 	h.msgCh <- e
 	return nil
 }
@@ -231,7 +387,11 @@ func (h *FSMHandler) recvMessage() error {
 
 func (h *FSMHandler) opensent() bgp.FSMState {
 	fsm := h.fsm
+	span := startFSMSpan(fsm, "opensent")
+	defer span.Finish()
+
 	m := buildopen(fsm.globalConfig, fsm.peerConfig)
+	span.SetTag("bgp.as", fsm.globalConfig.As)
 	b, _ := m.Serialize()
 	fsm.passiveConn.Write(b)
 	fsm.bgpMessageStateUpdate(m.Header.Type, false)
@@ -241,27 +401,55 @@ func (h *FSMHandler) opensent() bgp.FSMState {
 
 	h.t.Go(h.recvMessage)
 
+	holdTimer := time.NewTimer(time.Second * holdtimeOpensent)
+	defer holdTimer.Stop()
+	span.SetTag("bgp.holdtime", holdtimeOpensent)
+
 	nextState := bgp.BGP_FSM_IDLE
 	select {
 	case <-h.t.Dying():
 		fsm.passiveConn.Close()
 		return 0
+	case <-holdTimer.C:
+		h.sendNotification(bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, bgp.BGP_ERROR_SUB_HOLD_TIMER_EXPIRED, nil, "hold timer expired in OpenSent")
+		tagNotification(span, bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, bgp.BGP_ERROR_SUB_HOLD_TIMER_EXPIRED)
+		fsm.peerConfig.BgpNeighborCommonState.ExpiredHoldTimerCount++
+		fsm.passiveConn.Close()
 	case e := <-h.msgCh:
 		m := e.MsgData.(*bgp.BGPMessage)
 		fsm.bgpMessageStateUpdate(m.Header.Type, true)
+		tagMessage(span, m.Header.Type, true)
 		if m.Header.Type == bgp.BGP_MSG_OPEN {
+			if err := h.validateOpenMessage(m); err != nil {
+				span.SetTag("error", true)
+				fsm.passiveConn.Close()
+				break
+			}
+			span.SetTag("bgp.peer_as", fsm.peerConfig.PeerAs)
+			body := m.Body.(*bgp.BGPOpen)
+			fsm.negotiatedHoldTime = negotiateHoldTime(fsm.peerConfig.Timers.HoldTime, int(body.HoldTime))
+			span.SetTag("bgp.holdtime.negotiated", fsm.negotiatedHoldTime)
+			if restartTime, ok := parsePeerGracefulRestartCapability(m); ok {
+				fsm.gracefulRestart.peerRestartTime = restartTime
+			}
 			e := &fsmMsg{
 				MsgType: FSM_MSG_BGP_MESSAGE,
 				MsgData: m,
 			}
-			fsm.incoming <- e
+			if !h.pushIncoming(e) {
+				fsm.passiveConn.Close()
+				break
+			}
 			msg := bgp.NewBGPKeepAliveMessage()
 			b, _ := msg.Serialize()
 			fsm.passiveConn.Write(b)
 			fsm.bgpMessageStateUpdate(m.Header.Type, false)
 			nextState = bgp.BGP_FSM_OPENCONFIRM
+		} else if m.Header.Type == bgp.BGP_MSG_NOTIFICATION {
+			fsm.passiveConn.Close()
 		} else {
-			// send error
+			h.sendNotification(bgp.BGP_ERROR_FSM_ERROR, 0, nil, "unexpected message in OpenSent")
+			fsm.passiveConn.Close()
 		}
 	case <-h.errorCh:
 	}
@@ -270,6 +458,9 @@ func (h *FSMHandler) opensent() bgp.FSMState {
 
 func (h *FSMHandler) openconfirm() bgp.FSMState {
 	fsm := h.fsm
+	span := startFSMSpan(fsm, "openconfirm")
+	defer span.Finish()
+
 	sec := time.Second * time.Duration(fsm.peerConfig.Timers.KeepaliveInterval)
 	fsm.keepaliveTicker = time.NewTicker(sec)
 
@@ -278,32 +469,46 @@ func (h *FSMHandler) openconfirm() bgp.FSMState {
 
 	h.t.Go(h.recvMessage)
 
+	holdTimer := time.NewTimer(fsm.negotiatedHoldTime)
+	defer holdTimer.Stop()
+
 	for {
 		select {
 		case <-h.t.Dying():
 			fsm.passiveConn.Close()
 			return 0
+		case <-holdTimer.C:
+			h.sendNotification(bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, bgp.BGP_ERROR_SUB_HOLD_TIMER_EXPIRED, nil, "hold timer expired in OpenConfirm")
+			tagNotification(span, bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, bgp.BGP_ERROR_SUB_HOLD_TIMER_EXPIRED)
+			fsm.peerConfig.BgpNeighborCommonState.ExpiredHoldTimerCount++
+			fsm.passiveConn.Close()
+			return bgp.BGP_FSM_IDLE
 		case <-fsm.keepaliveTicker.C:
 			m := bgp.NewBGPKeepAliveMessage()
 			b, _ := m.Serialize()
 			// TODO: check error
 			fsm.passiveConn.Write(b)
+			fsm.bgpMessageStateUpdate(m.Header.Type, false)
 		case e := <-h.msgCh:
 			m := e.MsgData.(*bgp.BGPMessage)
 			nextState := bgp.BGP_FSM_IDLE
 			fsm.bgpMessageStateUpdate(m.Header.Type, true)
+			tagMessage(span, m.Header.Type, true)
 			if m.Header.Type == bgp.BGP_MSG_KEEPALIVE {
 				nextState = bgp.BGP_FSM_ESTABLISHED
+				fsm.connectAttempt = 0
+				fsm.idleAttempt = 0
+			} else if m.Header.Type == bgp.BGP_MSG_NOTIFICATION {
+				fsm.passiveConn.Close()
 			} else {
-				// send error
+				h.sendNotification(bgp.BGP_ERROR_FSM_ERROR, 0, nil, "unexpected message in OpenConfirm")
+				fsm.passiveConn.Close()
 			}
 			return nextState
 		case <-h.errorCh:
 			return bgp.BGP_FSM_IDLE
 		}
 	}
-	// panic
-	return 0
 }
 
 func (h *FSMHandler) sendMessageloop() error {
@@ -313,16 +518,22 @@ func (h *FSMHandler) sendMessageloop() error {
 		select {
 		case <-h.t.Dying():
 			return nil
-		case m := <-fsm.outgoing:
+		case v := <-fsm.outgoing.Out():
+			m := v.(*bgp.BGPMessage)
+			span := startFSMSpan(fsm, "send_message")
+			tagMessage(span, m.Header.Type, false)
 			b, _ := m.Serialize()
 			_, err := conn.Write(b)
 			if err != nil {
+				span.SetTag("error", true)
+				span.Finish()
 				h.errorCh <- true
 				return nil
 			}
 			j, _ := json.Marshal(m)
 			log.Debugf("sent %v: %s", fsm.peerConfig.NeighborAddress, string(j))
 			fsm.bgpMessageStateUpdate(m.Header.Type, false)
+			span.Finish()
 		case <-fsm.keepaliveTicker.C:
 			m := bgp.NewBGPKeepAliveMessage()
 			b, _ := m.Serialize()
@@ -347,14 +558,43 @@ func (h *FSMHandler) recvMessageloop() error {
 
 func (h *FSMHandler) established() bgp.FSMState {
 	fsm := h.fsm
+	span := startFSMSpan(fsm, "established")
+	defer span.Finish()
+
+	fsm.cancelStalePathTimer()
+
 	h.conn = fsm.passiveConn
 	h.t.Go(h.sendMessageloop)
-	h.msgCh = fsm.incoming
+	h.msgCh = make(chan *fsmMsg)
 	h.t.Go(h.recvMessageloop)
 
+	holdTime := fsm.negotiatedHoldTime
+	holdTimer := time.NewTimer(holdTime)
+	defer holdTimer.Stop()
+
 	for {
 		select {
+		case e := <-h.msgCh:
+			holdTimer.Reset(holdTime)
+			if m, ok := e.MsgData.(*bgp.BGPMessage); ok && m.Header.Type == bgp.BGP_MSG_UPDATE && isEndOfRib(m) {
+				fsm.markEndOfRib()
+			}
+			if !h.pushIncoming(e) {
+				fsm.startStalePathTimer()
+				h.conn.Close()
+				h.t.Kill(nil)
+				return bgp.BGP_FSM_IDLE
+			}
+		case <-holdTimer.C:
+			h.sendNotification(bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, bgp.BGP_ERROR_SUB_HOLD_TIMER_EXPIRED, nil, "hold timer expired in Established")
+			tagNotification(span, bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, bgp.BGP_ERROR_SUB_HOLD_TIMER_EXPIRED)
+			fsm.peerConfig.BgpNeighborCommonState.ExpiredHoldTimerCount++
+			fsm.startStalePathTimer()
+			h.conn.Close()
+			h.t.Kill(nil)
+			return bgp.BGP_FSM_IDLE
 		case <-h.errorCh:
+			fsm.startStalePathTimer()
 			h.conn.Close()
 			h.t.Kill(nil)
 			return bgp.BGP_FSM_IDLE
@@ -363,17 +603,19 @@ func (h *FSMHandler) established() bgp.FSMState {
 			return 0
 		}
 	}
-	return 0
 }
 
 func (h *FSMHandler) loop() error {
 	fsm := h.fsm
+	span := startFSMSpan(fsm, "fsm_loop")
+	defer span.Finish()
+
 	nextState := bgp.FSMState(0)
 	switch fsm.state {
 	case bgp.BGP_FSM_IDLE:
 		nextState = h.idle()
-		//	case bgp.BGP_FSM_CONNECT:
-		//		return h.connect()
+	case bgp.BGP_FSM_CONNECT:
+		nextState = h.connect()
 	case bgp.BGP_FSM_ACTIVE:
 		nextState = h.active()
 	case bgp.BGP_FSM_OPENSENT:
@@ -384,13 +626,15 @@ func (h *FSMHandler) loop() error {
 		nextState = h.established()
 	}
 
+	span.SetTag("fsm.next_state", nextState.String())
+
 	// zero means that tomb.Dying()
 	if nextState >= bgp.BGP_FSM_IDLE {
 		e := &fsmMsg{
 			MsgType: FSM_MSG_STATE_CHANGE,
 			MsgData: nextState,
 		}
-		fsm.incoming <- e
+		fsm.incoming.In() <- e
 	}
 	return nil
 }
@@ -0,0 +1,169 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/osrg/gobgp/config"
+	"github.com/osrg/gobgp/packet"
+)
+
+// StaleRouteHandler lets the FSM mark/clear/purge a peer's routes on
+// graceful restart without depending on RIB internals.
+type StaleRouteHandler interface {
+	MarkStale(neighbor net.IP)
+	ClearStale(neighbor net.IP)
+	PurgeStale(neighbor net.IP)
+}
+
+// gracefulRestartState tracks a peer's negotiated RFC 4724 parameters
+// and Stale Path Timer. mu guards stalePathTimer/restarting/eorReceived,
+// which are also touched from the timer's own AfterFunc callback.
+type gracefulRestartState struct {
+	mu              sync.Mutex
+	peerRestartTime time.Duration
+	stalePathTimer  *time.Timer
+	restarting      bool
+	eorReceived     bool
+}
+
+// buildGracefulRestartCapability advertises Graceful Restart (RFC 4724)
+// when enabled for this neighbor.
+func buildGracefulRestartCapability(peerConf *config.NeighborType) bgp.ParameterCapabilityInterface {
+	gr := peerConf.GracefulRestart
+	if !gr.Enabled {
+		return nil
+	}
+
+	var flags uint8
+	if gr.RestartFlagSet {
+		flags |= bgp.BGP_CAP_GRACEFUL_RESTART_RESTART_STATE
+	}
+
+	tuples := make([]*bgp.CapGracefulRestartTuple, 0, len(peerConf.AfiSafiList))
+	for _, afiSafi := range peerConf.AfiSafiList {
+		afi, safi := bgp.RouteFamilyToAfiSafi(afiSafi.AfiSafiName)
+		tuples = append(tuples, bgp.NewCapGracefulRestartTuple(afi, safi, gr.ForwardingState))
+	}
+
+	return bgp.NewCapGracefulRestart(flags, uint16(gr.RestartTime), tuples)
+}
+
+// parsePeerGracefulRestartCapability returns the peer's advertised
+// Restart Time, if it sent the capability in its OPEN message.
+func parsePeerGracefulRestartCapability(m *bgp.BGPMessage) (time.Duration, bool) {
+	body := m.Body.(*bgp.BGPOpen)
+	for _, p := range body.OptParams {
+		paramCap, ok := p.(*bgp.OptionParameterCapability)
+		if !ok {
+			continue
+		}
+		for _, c := range paramCap.Capability {
+			gr, ok := c.(*bgp.CapGracefulRestart)
+			if !ok {
+				continue
+			}
+			return time.Second * time.Duration(gr.Time), true
+		}
+	}
+	return 0, false
+}
+
+// isEndOfRib reports whether m is the End-of-RIB marker RFC 4724 defines
+// for the IPv4 unicast family: an UPDATE with nothing in it.
+func isEndOfRib(m *bgp.BGPMessage) bool {
+	u, ok := m.Body.(*bgp.BGPUpdate)
+	if !ok {
+		return false
+	}
+	return len(u.WithdrawnRoutes) == 0 && len(u.PathAttributes) == 0 && len(u.NLRI) == 0
+}
+
+// markEndOfRib records that the peer has re-sent everything it's going
+// to for this restart cycle, so the Stale Path Timer knows not to purge.
+func (fsm *FSM) markEndOfRib() {
+	gr := fsm.gracefulRestart
+	if gr == nil {
+		return
+	}
+	gr.mu.Lock()
+	gr.eorReceived = true
+	gr.mu.Unlock()
+}
+
+// startStalePathTimer marks the peer's routes stale on session drop and
+// schedules PurgeStale for when its Restart Time elapses, unless the
+// peer re-sends End-of-RIB before then.
+func (fsm *FSM) startStalePathTimer() {
+	gr := fsm.gracefulRestart
+	if gr == nil {
+		return
+	}
+	gr.mu.Lock()
+	if gr.peerRestartTime == 0 || gr.restarting {
+		gr.mu.Unlock()
+		return
+	}
+	gr.restarting = true
+	gr.eorReceived = false
+	gr.mu.Unlock()
+
+	if fsm.staleRouteHandler != nil {
+		fsm.staleRouteHandler.MarkStale(fsm.peerConfig.NeighborAddress)
+	}
+	neighbor := fsm.peerConfig.NeighborAddress
+	timer := time.AfterFunc(gr.peerRestartTime, func() {
+		gr.mu.Lock()
+		eor := gr.eorReceived
+		gr.mu.Unlock()
+		if !eor && fsm.staleRouteHandler != nil {
+			fsm.staleRouteHandler.PurgeStale(neighbor)
+		}
+		gr.mu.Lock()
+		gr.restarting = false
+		gr.mu.Unlock()
+	})
+	gr.mu.Lock()
+	gr.stalePathTimer = timer
+	gr.mu.Unlock()
+}
+
+// cancelStalePathTimer stops the Stale Path Timer on session recovery
+// and clears the stale mark on whatever routes survived it.
+func (fsm *FSM) cancelStalePathTimer() {
+	gr := fsm.gracefulRestart
+	if gr == nil {
+		return
+	}
+	gr.mu.Lock()
+	if gr.stalePathTimer == nil {
+		gr.mu.Unlock()
+		return
+	}
+	gr.stalePathTimer.Stop()
+	gr.stalePathTimer = nil
+	wasRestarting := gr.restarting
+	gr.restarting = false
+	gr.eorReceived = false
+	gr.mu.Unlock()
+
+	if wasRestarting && fsm.staleRouteHandler != nil {
+		fsm.staleRouteHandler.ClearStale(fsm.peerConfig.NeighborAddress)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// RIB is the route table every FSM reports graceful-restart staleness
+// to. It implements StaleRouteHandler; actual per-route storage is
+// outside this tree's scope, so it only tracks which neighbors are
+// currently in a stale/restarting state.
+type RIB struct {
+	mu    sync.Mutex
+	stale map[string]bool
+}
+
+// NewRIB creates an empty RIB.
+func NewRIB() *RIB {
+	return &RIB{stale: make(map[string]bool)}
+}
+
+// defaultRIB is the RIB every FSM reports to unless overridden via
+// FSM.SetStaleRouteHandler.
+var defaultRIB = NewRIB()
+
+func (r *RIB) MarkStale(neighbor net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stale[neighbor.String()] = true
+}
+
+func (r *RIB) ClearStale(neighbor net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.stale, neighbor.String())
+}
+
+func (r *RIB) PurgeStale(neighbor net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.stale, neighbor.String())
+	// TODO: once route storage exists here, walk it and drop whatever
+	// is still marked stale for this neighbor.
+}
+
+// IsStale reports whether neighbor's routes are currently marked stale.
+func (r *RIB) IsStale(neighbor net.IP) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stale[neighbor.String()]
+}
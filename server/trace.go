@@ -0,0 +1,75 @@
+// Copyright (C) 2014 Nippon Telegraph and Telephone Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	opentracing "github.com/opentracing/opentracing-go"
+	zipkintracer "github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/osrg/gobgp/config"
+)
+
+// tracer defaults to the no-op tracer until InitTracer is called.
+var tracer opentracing.Tracer = opentracing.NoopTracer{}
+
+// InitTracer sets up the global tracer from the collector config.
+func InitTracer(g *config.GlobalType) error {
+	if !g.Collector.Enabled {
+		return nil
+	}
+
+	collector, err := zipkintracer.NewHTTPCollector(g.Collector.Address)
+	if err != nil {
+		return fmt.Errorf("failed to create zipkin collector: %s", err)
+	}
+
+	recorder := zipkintracer.NewRecorder(collector, false, g.RouterId.String(), "gobgpd")
+	zt, err := zipkintracer.NewTracer(recorder)
+	if err != nil {
+		return fmt.Errorf("failed to create zipkin tracer: %s", err)
+	}
+
+	tracer = zt
+	opentracing.SetGlobalTracer(zt)
+	log.Infof("tracing enabled, reporting to %s", g.Collector.Address)
+	return nil
+}
+
+// startFSMSpan opens a span tagged with the neighbor address and state.
+func startFSMSpan(fsm *FSM, operation string) opentracing.Span {
+	span := tracer.StartSpan(operation)
+	span.SetTag("peer.addr", fsm.peerConfig.NeighborAddress.String())
+	span.SetTag("fsm.state", fsm.state.String())
+	return span
+}
+
+// tagNotification annotates span with the NOTIFICATION code/subcode.
+func tagNotification(span opentracing.Span, code, subcode uint8) {
+	span.SetTag("bgp.notification.code", code)
+	span.SetTag("bgp.notification.subcode", subcode)
+}
+
+// tagMessage annotates span with the BGP message type and direction.
+func tagMessage(span opentracing.Span, msgType uint8, isIn bool) {
+	span.SetTag("bgp.message.type", msgType)
+	if isIn {
+		span.SetTag("bgp.message.direction", "in")
+	} else {
+		span.SetTag("bgp.message.direction", "out")
+	}
+}